@@ -0,0 +1,365 @@
+// Package event_parser turns a stream of Bazel build events (BEP) into
+// the fields of an Invocation proto.
+package event_parser
+
+import (
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redact"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	allowEnvMetadataKey = "ALLOW_ENV"
+	roleMetadataKey     = "ROLE"
+	repoURLMetadataKey  = "REPO_URL"
+	buildUserStatusKey  = "BUILD_USER"
+)
+
+// Redactor removes sensitive substrings -- secrets, tokens, API keys --
+// from invocation text before it is surfaced to FillInvocation's caller.
+// It is satisfied by *redact.Redactor as well as by test doubles.
+type Redactor interface {
+	RedactString(s string, allowedEnvVars map[string]struct{}) string
+}
+
+// EventContext carries information that's derived from the whole event
+// stream rather than from any single event, so handlers don't have to
+// care what order events arrived in. For example, the ALLOW_ENV
+// allowlist comes from a BuildMetadata event that may arrive after the
+// client_env options it governs.
+type EventContext struct {
+	// AllowedEnvVars are environment variable names that should never be
+	// redacted, sourced from the BuildMetadata event's ALLOW_ENV key.
+	AllowedEnvVars map[string]struct{}
+}
+
+// EventHandler lets plugins contribute derived fields to an Invocation
+// without editing the core parser. Built-in handlers implement the
+// parser's historical behavior (progress concatenation, workspace
+// status, build metadata, redaction); downstream integrators can
+// register their own, for example to extract test flakiness signals from
+// repeated TestResult events, compute per-target wall time from
+// TargetConfigured/TargetComplete pairs, or emit a critical-path
+// summary.
+type EventHandler interface {
+	// HandleEvent is called once for every BuildEvent parsed so far, in
+	// the order it was parsed, on each FillInvocation call; events parsed
+	// before an earlier FillInvocation call are passed in again.
+	// Implementations that need to mutate the event itself (e.g. to
+	// redact it) should do so here.
+	HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext)
+	// Contribute is called once per FillInvocation call, after every
+	// event has been seen via HandleEvent, and should write this
+	// handler's derived fields onto inv.
+	Contribute(inv *inpb.Invocation)
+}
+
+// StreamingEventParser accumulates a stream of BuildEvents and, once the
+// stream is complete, fills in the derived fields of an Invocation proto
+// by running each registered EventHandler over it.
+type StreamingEventParser struct {
+	handlers []EventHandler
+	events   []*build_event_stream.BuildEvent
+}
+
+// NewStreamingEventParser returns a parser with the built-in handlers
+// registered, redacting secrets using redact.DefaultConfig. Use
+// NewStreamingEventParserWithRedactor to supply a server-config-driven
+// Redactor instead.
+func NewStreamingEventParser() *StreamingEventParser {
+	return NewStreamingEventParserWithRedactor(redact.New(redact.DefaultConfig()))
+}
+
+// NewStreamingEventParserWithRedactor returns a parser with the built-in
+// handlers registered, using r to redact secrets from invocation text.
+func NewStreamingEventParserWithRedactor(r Redactor) *StreamingEventParser {
+	return &StreamingEventParser{
+		handlers: []EventHandler{
+			&progressHandler{redactor: r},
+			&commandHandler{redactor: r},
+			&durationHandler{},
+			&fileURIHandler{},
+			&structuredCommandLineHandler{redactor: r},
+			&workspaceStatusHandler{},
+			&buildMetadataHandler{},
+		},
+	}
+}
+
+// RegisterEventHandler adds handler to the set run by FillInvocation, in
+// addition to the built-in handlers. Handlers run in registration order;
+// built-in handlers always run first.
+func (p *StreamingEventParser) RegisterEventHandler(handler EventHandler) {
+	p.handlers = append(p.handlers, handler)
+}
+
+// ParseEvent records event for processing by FillInvocation. Events are
+// processed in the order they were parsed.
+func (p *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
+	p.events = append(p.events, event.GetBuildEvent())
+}
+
+// FillInvocation runs every registered EventHandler over the events
+// parsed so far, then has each handler contribute its derived fields to
+// invocation.
+func (p *StreamingEventParser) FillInvocation(invocation *inpb.Invocation) {
+	ctx := &EventContext{AllowedEnvVars: p.allowedEnvVars()}
+
+	for _, event := range p.events {
+		for _, h := range p.handlers {
+			h.HandleEvent(event, ctx)
+		}
+	}
+	for _, h := range p.handlers {
+		h.Contribute(invocation)
+	}
+}
+
+// allowedEnvVars scans the parsed events for a BuildMetadata event and
+// returns the set of environment variable names listed in its ALLOW_ENV
+// key, which are never redacted even if they'd otherwise match a
+// sensitive env-var-name pattern.
+func (p *StreamingEventParser) allowedEnvVars() map[string]struct{} {
+	allowed := make(map[string]struct{})
+	for _, event := range p.events {
+		metadata, ok := event.GetPayload().(*build_event_stream.BuildEvent_BuildMetadata)
+		if !ok {
+			continue
+		}
+		for _, name := range strings.Split(metadata.BuildMetadata.Metadata[allowEnvMetadataKey], ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				allowed[name] = struct{}{}
+			}
+		}
+	}
+	return allowed
+}
+
+// progressHandler concatenates Progress.Stderr/Stdout (redacted) into the
+// invocation's console buffer, clearing the fields on the original event
+// so the raw text isn't stored twice.
+type progressHandler struct {
+	redactor Redactor
+	buf      strings.Builder
+}
+
+func (h *progressHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	progress, ok := event.GetPayload().(*build_event_stream.BuildEvent_Progress)
+	if !ok {
+		return
+	}
+	h.buf.WriteString(h.redactor.RedactString(progress.Progress.Stderr, ctx.AllowedEnvVars))
+	h.buf.WriteString(h.redactor.RedactString(progress.Progress.Stdout, ctx.AllowedEnvVars))
+	progress.Progress.Stderr = ""
+	progress.Progress.Stdout = ""
+}
+
+func (h *progressHandler) Contribute(inv *inpb.Invocation) {
+	inv.ConsoleBuffer = h.buf.String()
+}
+
+// commandHandler captures the command bazel was invoked with, and
+// redacts the option/command-line fields that describe it.
+type commandHandler struct {
+	redactor Redactor
+	command  string
+	sawStart bool
+}
+
+func (h *commandHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	switch payload := event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Started:
+		h.command = payload.Started.Command
+		h.sawStart = true
+		payload.Started.OptionsDescription = h.redactor.RedactString(stripIDPrefix(payload.Started.OptionsDescription), ctx.AllowedEnvVars)
+	case *build_event_stream.BuildEvent_OptionsParsed:
+		redactAndStripAll(payload.OptionsParsed.CmdLine, h.redactor, ctx.AllowedEnvVars)
+		redactAndStripAll(payload.OptionsParsed.ExplicitCmdLine, h.redactor, ctx.AllowedEnvVars)
+	}
+}
+
+// Contribute only writes inv.Command if a BuildStarted event was seen,
+// so that calling FillInvocation before BuildStarted has arrived doesn't
+// clobber a value already set by an earlier pass.
+func (h *commandHandler) Contribute(inv *inpb.Invocation) {
+	if h.sawStart {
+		inv.Command = h.command
+	}
+}
+
+// durationHandler computes the invocation's wall-clock duration from the
+// BuildStarted/BuildFinished timestamps.
+type durationHandler struct {
+	startTimeMillis  int64
+	finishTimeMillis int64
+	sawFinish        bool
+}
+
+func (h *durationHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	switch payload := event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Started:
+		h.startTimeMillis = payload.Started.StartTimeMillis
+	case *build_event_stream.BuildEvent_Finished:
+		h.finishTimeMillis = payload.Finished.FinishTimeMillis
+		h.sawFinish = true
+	}
+}
+
+// Contribute only writes inv.DurationUsec if a BuildFinished event was
+// seen, so that calling FillInvocation on an in-progress invocation
+// (after BuildStarted but before BuildFinished) doesn't overwrite the
+// duration with a negative value computed against a zero finish time.
+func (h *durationHandler) Contribute(inv *inpb.Invocation) {
+	if h.sawFinish {
+		inv.DurationUsec = (h.finishTimeMillis - h.startTimeMillis) * 1000
+	}
+}
+
+// fileURIHandler strips bazel's unique correlation-id prefix from every
+// file URI referenced by the build, across all the event types that
+// reference output files. It doesn't contribute any Invocation field
+// directly; it just cleans up the events in place before they're stored.
+type fileURIHandler struct{}
+
+func (h *fileURIHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	switch payload := event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Action:
+		fixFile(payload.Action.Stdout)
+		fixFile(payload.Action.Stderr)
+		fixFile(payload.Action.PrimaryOutput)
+		fixFiles(payload.Action.ActionMetadataLogs)
+	case *build_event_stream.BuildEvent_NamedSetOfFiles:
+		fixFiles(payload.NamedSetOfFiles.Files)
+	case *build_event_stream.BuildEvent_Completed:
+		fixFiles(payload.Completed.ImportantOutput)
+	case *build_event_stream.BuildEvent_TestResult:
+		fixFiles(payload.TestResult.TestActionOutput)
+	case *build_event_stream.BuildEvent_TestSummary:
+		fixFiles(payload.TestSummary.Passed)
+		fixFiles(payload.TestSummary.Failed)
+	}
+}
+
+func (h *fileURIHandler) Contribute(inv *inpb.Invocation) {}
+
+// structuredCommandLineHandler redacts the client_env (and other)
+// options carried by the StructuredCommandLine event.
+type structuredCommandLineHandler struct {
+	redactor Redactor
+}
+
+func (h *structuredCommandLineHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	payload, ok := event.GetPayload().(*build_event_stream.BuildEvent_StructuredCommandLine)
+	if !ok {
+		return
+	}
+	for _, section := range payload.StructuredCommandLine.GetSections() {
+		optionList, ok := section.GetSectionType().(*command_line.CommandLineSection_OptionList)
+		if !ok {
+			continue
+		}
+		for _, opt := range optionList.OptionList.Option {
+			opt.OptionValue = h.redactor.RedactString(opt.OptionValue, ctx.AllowedEnvVars)
+			opt.CombinedForm = h.redactor.RedactString(opt.CombinedForm, ctx.AllowedEnvVars)
+		}
+	}
+}
+
+func (h *structuredCommandLineHandler) Contribute(inv *inpb.Invocation) {}
+
+// workspaceStatusHandler extracts the invoking user from WorkspaceStatus.
+type workspaceStatusHandler struct {
+	user   string
+	sawKey bool
+}
+
+func (h *workspaceStatusHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	payload, ok := event.GetPayload().(*build_event_stream.BuildEvent_WorkspaceStatus)
+	if !ok {
+		return
+	}
+	for _, item := range payload.WorkspaceStatus.Item {
+		if item.Key == buildUserStatusKey {
+			h.user = item.Value
+			h.sawKey = true
+		}
+	}
+}
+
+// Contribute only writes inv.User if a BUILD_USER workspace status item
+// was seen, so that calling FillInvocation before WorkspaceStatus has
+// arrived doesn't clobber a value already set by an earlier pass.
+func (h *workspaceStatusHandler) Contribute(inv *inpb.Invocation) {
+	if h.sawKey {
+		inv.User = h.user
+	}
+}
+
+// buildMetadataHandler extracts CI-provided metadata like the triggering
+// role and repo URL from the BuildMetadata event.
+type buildMetadataHandler struct {
+	role        string
+	repoURL     string
+	sawMetadata bool
+}
+
+func (h *buildMetadataHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *EventContext) {
+	payload, ok := event.GetPayload().(*build_event_stream.BuildEvent_BuildMetadata)
+	if !ok {
+		return
+	}
+	h.role = payload.BuildMetadata.Metadata[roleMetadataKey]
+	h.repoURL = payload.BuildMetadata.Metadata[repoURLMetadataKey]
+	h.sawMetadata = true
+}
+
+// Contribute only writes inv.Role/inv.RepoUrl if a BuildMetadata event
+// was seen, so that calling FillInvocation before BuildMetadata has
+// arrived doesn't clobber values already set by an earlier pass.
+func (h *buildMetadataHandler) Contribute(inv *inpb.Invocation) {
+	if h.sawMetadata {
+		inv.Role = h.role
+		inv.RepoUrl = h.repoURL
+	}
+}
+
+// redactAndStripAll redacts secrets from each element of args in place,
+// after first stripping the leading unique-ID prefix that bazel attaches
+// to these fields (see stripIDPrefix).
+func redactAndStripAll(args []string, r Redactor, allowedEnvVars map[string]struct{}) {
+	for i, arg := range args {
+		args[i] = r.RedactString(stripIDPrefix(arg), allowedEnvVars)
+	}
+}
+
+// stripIDPrefix removes bazel's unique correlation-id prefix (everything
+// up to and including the first "@") from fields like
+// BuildStarted.OptionsDescription and OptionsParsed.CmdLine, which aren't
+// useful to display to users.
+func stripIDPrefix(s string) string {
+	if idx := strings.Index(s, "@"); idx >= 0 {
+		return s[idx+1:]
+	}
+	return s
+}
+
+// fixFile strips the unique-ID prefix from f's URI, if any. It is a
+// no-op for files that aren't referenced by URI (e.g. inline contents).
+func fixFile(f *build_event_stream.File) {
+	if f == nil {
+		return
+	}
+	if uri, ok := f.File.(*build_event_stream.File_Uri); ok {
+		uri.Uri = stripIDPrefix(uri.Uri)
+	}
+}
+
+func fixFiles(files []*build_event_stream.File) {
+	for _, f := range files {
+		fixFile(f)
+	}
+}
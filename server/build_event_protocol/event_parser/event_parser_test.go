@@ -1,6 +1,7 @@
 package event_parser_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
@@ -238,8 +239,96 @@ func TestFillInvocation(t *testing.T) {
 
 	assert.Equal(t, "SHELL=/bin/bash", shellOption.OptionValue)
 	assert.Equal(t, "SECRET=<REDACTED>", secretOption.OptionValue)
+	assert.Equal(t, "--client_env=SHELL=/bin/bash", shellOption.CombinedForm)
+	assert.Equal(t, "--client_env=SECRET=<REDACTED>", secretOption.CombinedForm)
 
 	assert.Equal(t, "WORKSPACE_STATUS_BUILD_USER", invocation.User)
 	assert.Equal(t, "METADATA_CI", invocation.Role)
 	assert.Equal(t, "https://github.com/buildbuddy-io/metadata_repo_url", invocation.RepoUrl)
 }
+
+// TestFillInvocation_InProgress covers calling FillInvocation on an
+// invocation that's still running: only BuildStarted has arrived, not
+// BuildFinished, WorkspaceStatus, or BuildMetadata. Fields derived from
+// events that haven't arrived yet must be left untouched rather than
+// clobbered with the handlers' zero values.
+func TestFillInvocation_InProgress(t *testing.T) {
+	buildStarted := &build_event_stream.BuildStarted{
+		StartTimeMillis: 100,
+		Command:         "build",
+	}
+	event := &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Payload: &build_event_stream.BuildEvent_Started{buildStarted},
+		},
+	}
+
+	invocation := &inpb.Invocation{
+		DurationUsec: 555,
+		User:         "prior-user",
+		Role:         "prior-role",
+		RepoUrl:      "prior-url",
+		Command:      "prior-command",
+	}
+	parser := event_parser.NewStreamingEventParser()
+	parser.ParseEvent(event)
+	parser.FillInvocation(invocation)
+
+	assert.Equal(t, "build", invocation.Command, "Command should update: BuildStarted was seen")
+	assert.Equal(t, int64(555), invocation.DurationUsec, "DurationUsec should be untouched: BuildFinished wasn't seen")
+	assert.Equal(t, "prior-user", invocation.User, "User should be untouched: WorkspaceStatus wasn't seen")
+	assert.Equal(t, "prior-role", invocation.Role, "Role should be untouched: BuildMetadata wasn't seen")
+	assert.Equal(t, "prior-url", invocation.RepoUrl, "RepoUrl should be untouched: BuildMetadata wasn't seen")
+}
+
+// countingEventHandler is a test EventHandler that counts TestResult
+// events and reports the count via RepoUrl, to prove that custom
+// handlers registered with RegisterEventHandler run (and can contribute
+// after the built-in handlers).
+type countingEventHandler struct {
+	testResults int
+}
+
+func (h *countingEventHandler) HandleEvent(event *build_event_stream.BuildEvent, ctx *event_parser.EventContext) {
+	if _, ok := event.GetPayload().(*build_event_stream.BuildEvent_TestResult); ok {
+		h.testResults++
+	}
+}
+
+func (h *countingEventHandler) Contribute(inv *inpb.Invocation) {
+	inv.RepoUrl = fmt.Sprintf("custom-handler-saw-%d-test-results", h.testResults)
+}
+
+func TestRegisterEventHandler(t *testing.T) {
+	makeTestResult := func() *inpb.InvocationEvent {
+		return &inpb.InvocationEvent{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Payload: &build_event_stream.BuildEvent_TestResult{
+					&build_event_stream.TestResult{Status: build_event_stream.TestStatus_PASSED},
+				},
+			},
+		}
+	}
+	buildMetadata := &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Payload: &build_event_stream.BuildEvent_BuildMetadata{
+				&build_event_stream.BuildMetadata{
+					Metadata: map[string]string{"REPO_URL": "https://original"},
+				},
+			},
+		},
+	}
+
+	parser := event_parser.NewStreamingEventParser()
+	handler := &countingEventHandler{}
+	parser.RegisterEventHandler(handler)
+
+	parser.ParseEvent(buildMetadata)
+	parser.ParseEvent(makeTestResult())
+	parser.ParseEvent(makeTestResult())
+
+	invocation := &inpb.Invocation{}
+	parser.FillInvocation(invocation)
+
+	assert.Equal(t, "custom-handler-saw-2-test-results", invocation.RepoUrl)
+}
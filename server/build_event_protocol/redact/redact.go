@@ -0,0 +1,120 @@
+// Package redact provides configurable redaction of secrets that can
+// otherwise leak into a build's invocation data: client_env values,
+// flags like `--define=API_KEY=...`, and free text such as command
+// output.
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redactedPlaceholder = "<REDACTED>"
+
+// Config controls which substrings a Redactor treats as sensitive. It is
+// intended to be loaded from the server config so operators can add
+// org-specific patterns without recompiling.
+type Config struct {
+	// ValuePatterns are regexes matched against arbitrary text (option
+	// values, command lines, stdout/stderr); any match is replaced with
+	// "<REDACTED>".
+	ValuePatterns []string `yaml:"value_patterns" json:"value_patterns"`
+	// EnvVarNamePatterns are regexes matched against environment
+	// variable names (e.g. the NAME half of a `--client_env=NAME=VALUE`
+	// option). A match means the variable's value is always treated as
+	// sensitive, regardless of what the value itself looks like.
+	EnvVarNamePatterns []string `yaml:"env_var_name_patterns" json:"env_var_name_patterns"`
+}
+
+// DefaultConfig returns the Config used when the server config doesn't
+// specify one: env vars that look like tokens, secrets, keys, or
+// passwords are redacted; no additional value patterns are configured.
+func DefaultConfig() *Config {
+	return &Config{
+		EnvVarNamePatterns: []string{
+			`(?i).*TOKEN`,
+			`(?i).*SECRET`,
+			`(?i).*KEY`,
+			`(?i).*PASSWORD`,
+		},
+	}
+}
+
+// Redactor removes sensitive substrings from invocation text and
+// command-line options before they're persisted or rendered in the UI.
+type Redactor struct {
+	valuePatterns   []*regexp.Regexp
+	envNamePatterns []*regexp.Regexp
+}
+
+// New compiles cfg into a Redactor. If cfg is nil, DefaultConfig is used.
+// Invalid patterns are skipped rather than causing New to fail, since a
+// single bad operator-supplied pattern shouldn't take down redaction
+// entirely.
+func New(cfg *Config) *Redactor {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	r := &Redactor{}
+	for _, p := range cfg.ValuePatterns {
+		if re, err := regexp.Compile(p); err == nil {
+			r.valuePatterns = append(r.valuePatterns, re)
+		}
+	}
+	for _, p := range cfg.EnvVarNamePatterns {
+		if re, err := regexp.Compile(p); err == nil {
+			r.envNamePatterns = append(r.envNamePatterns, re)
+		}
+	}
+	return r
+}
+
+// envAssignmentPattern matches a NAME=VALUE style assignment, optionally
+// preceded by a bazel flag prefix like `--client_env=` or `--define=`.
+// The leading flag (if any) is its own capture group so that a match like
+// `--define=API_KEY=abc123` redacts only the VALUE half of the *nested*
+// assignment (API_KEY=abc123) rather than misreading the flag name
+// itself ("define") as the env var name and leaving the real secret
+// untouched.
+var envAssignmentPattern = regexp.MustCompile(`(--[A-Za-z_][A-Za-z0-9_]*=)?([A-Za-z_][A-Za-z0-9_]*)=(\S*)`)
+
+// IsSensitiveEnvVar reports whether name matches one of the configured
+// EnvVarNamePatterns.
+func (r *Redactor) IsSensitiveEnvVar(name string) bool {
+	for _, re := range r.envNamePatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactString redacts any NAME=VALUE assignment in s whose NAME is a
+// sensitive env var (unless allowed by allowedEnvVars), as well as any
+// substring matching a configured value pattern.
+func (r *Redactor) RedactString(s string, allowedEnvVars map[string]struct{}) string {
+	for _, re := range r.valuePatterns {
+		s = re.ReplaceAllString(s, redactedPlaceholder)
+	}
+	return envAssignmentPattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := envAssignmentPattern.FindStringSubmatch(match)
+		flagPrefix, name := groups[1], groups[2]
+		if _, allowed := allowedEnvVars[name]; allowed {
+			return match
+		}
+		if r.IsSensitiveEnvVar(name) {
+			return flagPrefix + name + "=" + redactedPlaceholder
+		}
+		return match
+	})
+}
+
+// SplitEnvAssignment splits a "NAME=VALUE" string into its name and
+// value halves. ok is false if s does not contain a "=".
+func SplitEnvAssignment(s string) (name, value string, ok bool) {
+	idx := strings.Index(s, "=")
+	if idx < 0 {
+		return "", "", false
+	}
+	return s[:idx], s[idx+1:], true
+}
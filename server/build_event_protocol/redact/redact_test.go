@@ -0,0 +1,44 @@
+package redact_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redact"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactString_NestedFlagAssignment(t *testing.T) {
+	r := redact.New(redact.DefaultConfig())
+
+	assert.Equal(t, "--define=API_KEY=<REDACTED>", r.RedactString("--define=API_KEY=abc123", nil))
+	assert.Equal(t, "--client_env=SECRET=<REDACTED>", r.RedactString("--client_env=SECRET=codez", nil))
+}
+
+func TestRedactString_PlainAssignment(t *testing.T) {
+	r := redact.New(redact.DefaultConfig())
+
+	assert.Equal(t, "SECRET=<REDACTED>", r.RedactString("SECRET=codez", nil))
+	assert.Equal(t, "SHELL=/bin/bash", r.RedactString("SHELL=/bin/bash", nil))
+}
+
+func TestRedactString_Allowlist(t *testing.T) {
+	r := redact.New(redact.DefaultConfig())
+	allowed := map[string]struct{}{"API_KEY": {}}
+
+	assert.Equal(t, "--define=API_KEY=abc123", r.RedactString("--define=API_KEY=abc123", allowed))
+}
+
+func TestRedactString_CustomValuePattern(t *testing.T) {
+	r := redact.New(&redact.Config{ValuePatterns: []string{`sk-[A-Za-z0-9]+`}})
+
+	assert.Equal(t, "token=<REDACTED>", r.RedactString("token=sk-abc123", nil))
+}
+
+func TestDefaultConfig_EnvVarNamePatterns(t *testing.T) {
+	r := redact.New(redact.DefaultConfig())
+
+	for _, name := range []string{"API_TOKEN", "MY_SECRET", "API_KEY", "DB_PASSWORD"} {
+		assert.True(t, r.IsSensitiveEnvVar(name), "expected %q to be sensitive", name)
+	}
+	assert.False(t, r.IsSensitiveEnvVar("SHELL"))
+}
@@ -2,27 +2,30 @@ package healthcheck
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
-	maxShutdownDuration = flag.Duration("max_shutdown_duration", 25*time.Second, "Time to wait for shutdown")
+	maxShutdownDuration      = flag.Duration("max_shutdown_duration", 25*time.Second, "Time to wait for shutdown")
+	shutdownLameDuckDuration = flag.Duration("shutdown_lame_duck_duration", 5*time.Second, "Time to wait after catching SIGTERM before running shutdown functions, so that load balancers have a chance to stop sending new traffic")
 )
 
 const (
-	healthCheckPeriod  = 3 * time.Second // The time to wait between health checks.
-	healthCheckTimeout = 2 * time.Second // How long a health check may take, max.
+	healthCheckPeriod  = 3 * time.Second        // The default time to wait between health checks.
+	healthCheckTimeout = 2 * time.Second        // The default timeout for a single health check.
+	minHealthCheckTick = 100 * time.Millisecond // The tightest granularity the scheduling loop will wake up at, regardless of how short a checker's Interval is.
 )
 
 type Checker interface {
@@ -36,33 +39,230 @@ func (f CheckerFunc) Check(ctx context.Context) error {
 
 type ShutDownFunc func(ctx context.Context) error
 
+// shutdownFuncEntry pairs a registered ShutDownFunc with the priority
+// stage it runs in. Lower priorities run first.
+type shutdownFuncEntry struct {
+	fn       ShutDownFunc
+	priority int
+}
+
+// Severity controls whether a checker's failures are allowed to flip the
+// aggregate readiness bit.
+type Severity int
+
+const (
+	// SeverityCritical checkers gate readiness: once one of them is
+	// considered down (see CheckOptions.FailureThreshold), the service
+	// reports not-ready. This is the default, and matches the historical
+	// all-checks-must-pass behavior of AddHealthCheck.
+	SeverityCritical Severity = iota
+	// SeverityDegraded checkers never flip readiness. Their state is
+	// still visible via Status/DetailsHandler so that operators can see
+	// a flaky non-essential subsystem without taking the service out of
+	// the load balancing pool.
+	SeverityDegraded
+	// SeverityInfo checkers are purely informational; like Degraded,
+	// they never affect readiness.
+	SeverityInfo
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityCritical:
+		return "critical"
+	case SeverityDegraded:
+		return "degraded"
+	case SeverityInfo:
+		return "info"
+	default:
+		return "unknown"
+	}
+}
+
+// CheckOptions configures how a single registered checker is run and how
+// its failures are interpreted.
+type CheckOptions struct {
+	// Severity determines whether this checker's failures can flip the
+	// aggregate readiness bit. Defaults to SeverityCritical.
+	Severity Severity
+	// FailureThreshold is the number of consecutive failures required
+	// before the checker is considered down. Defaults to 1.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successes required
+	// for a down checker to be considered recovered. Defaults to 1.
+	SuccessThreshold int
+	// Interval overrides how often this checker is run. Defaults to
+	// healthCheckPeriod. The scheduling loop wakes up early to honor a
+	// shorter Interval, down to a floor of minHealthCheckTick.
+	Interval time.Duration
+	// Timeout overrides how long a single run of this checker may take.
+	// Defaults to healthCheckTimeout.
+	Timeout time.Duration
+}
+
+func (o CheckOptions) withDefaults() CheckOptions {
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 1
+	}
+	if o.SuccessThreshold <= 0 {
+		o.SuccessThreshold = 1
+	}
+	if o.Interval <= 0 {
+		o.Interval = healthCheckPeriod
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = healthCheckTimeout
+	}
+	return o
+}
+
+// Logger is the structured logging interface used by HealthChecker. It is
+// intentionally small so that callers can plug in the repo-wide structured
+// logger, a thin wrapper around *slog.Logger, or a test double without
+// pulling in extra dependencies. *slog.Logger itself does not have these
+// methods, so it has to be wrapped.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// defaultLogger forwards to the repo-wide structured logger so that
+// HealthChecker logs are tagged and formatted the same way as the rest of
+// the server by default.
+type defaultLogger struct{}
+
+func (defaultLogger) Debugf(format string, args ...interface{})   { log.Debugf(format, args...) }
+func (defaultLogger) Infof(format string, args ...interface{})    { log.Infof(format, args...) }
+func (defaultLogger) Warningf(format string, args ...interface{}) { log.Warningf(format, args...) }
+func (defaultLogger) Errorf(format string, args ...interface{})   { log.Errorf(format, args...) }
+
+// CheckerStatus is a point-in-time snapshot of a single registered
+// checker's health, returned by Status and served as JSON from
+// /healthz/details.
+type CheckerStatus struct {
+	// Name is the name the checker was registered under.
+	Name string `json:"name"`
+	// Severity is the checker's configured severity. See CheckOptions.
+	Severity Severity `json:"severity"`
+	// OK is true if the checker's most recent run succeeded.
+	OK bool `json:"ok"`
+	// Down is true if the checker has crossed its FailureThreshold and
+	// has not yet recovered across SuccessThreshold consecutive
+	// successes. Only Down checkers of SeverityCritical affect
+	// readiness.
+	Down bool `json:"down"`
+	// LastRun is when the checker was last run.
+	LastRun time.Time `json:"last_run"`
+	// Latency is how long the checker's most recent run took.
+	Latency time.Duration `json:"latency"`
+	// LastError is the error returned by the checker's most recent run. It
+	// is empty if that run succeeded.
+	LastError string `json:"last_error,omitempty"`
+	// ConsecutiveFailures is the number of consecutive runs that have
+	// failed. It resets to 0 on the next successful run.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+}
+
+// checkerState tracks a registered checker along with the bookkeeping
+// needed to run it on its own schedule and report its status.
+type checkerState struct {
+	checker Checker
+	opts    CheckOptions
+
+	lastRun              time.Time
+	lastLatency          time.Duration
+	lastErr              error
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	down                 bool
+}
+
+func (cs *checkerState) status(name string) CheckerStatus {
+	s := CheckerStatus{
+		Name:                name,
+		Severity:            cs.opts.Severity,
+		OK:                  cs.lastErr == nil,
+		Down:                cs.down,
+		LastRun:             cs.lastRun,
+		Latency:             cs.lastLatency,
+		ConsecutiveFailures: cs.consecutiveFailures,
+	}
+	if cs.lastErr != nil {
+		s.LastError = cs.lastErr.Error()
+	}
+	return s
+}
+
+// recordResult updates the checker's bookkeeping after a run and reports
+// whether its down/up transition (if any) should be reflected in the
+// aggregate readiness bit.
+func (cs *checkerState) recordResult(start time.Time, latency time.Duration, err error) (wasDown, nowDown bool) {
+	cs.lastRun = start
+	cs.lastLatency = latency
+	cs.lastErr = err
+	wasDown = cs.down
+
+	if err != nil {
+		cs.consecutiveFailures++
+		cs.consecutiveSuccesses = 0
+	} else {
+		cs.consecutiveSuccesses++
+		cs.consecutiveFailures = 0
+	}
+
+	if !cs.down && cs.consecutiveFailures >= cs.opts.FailureThreshold {
+		cs.down = true
+	} else if cs.down && cs.consecutiveSuccesses >= cs.opts.SuccessThreshold {
+		cs.down = false
+	}
+	return wasDown, cs.down
+}
+
 type HealthChecker struct {
 	serverType    string
 	done          chan bool
 	quit          chan os.Signal
-	shutdownFuncs []ShutDownFunc
+	shutdownFuncs []shutdownFuncEntry
+	logger        Logger
 
-	lock         sync.RWMutex // protects: readyToServe, shuttingDown
+	lock         sync.RWMutex // protects: readyToServe, shuttingDown, inLameDuck, checkers
 	readyToServe bool
 	shuttingDown bool
-	checkers     map[string]Checker
+	inLameDuck   bool
+	checkers     map[string]*checkerState
 }
 
 func NewHealthChecker(serverType string) *HealthChecker {
+	return NewHealthCheckerWithLogger(serverType, defaultLogger{})
+}
+
+// NewHealthCheckerWithLogger is like NewHealthChecker, but logs through l
+// instead of the repo-wide structured logger. It is most useful in
+// tests, where the default logger would otherwise write to the server's
+// global log stream.
+//
+// The logger is fixed at construction time rather than settable later:
+// the shutdown-signal and health-check-loop goroutines start immediately
+// below and read h.logger without holding h.lock (h.logger is only ever
+// written here), so a late setter would race with them.
+func NewHealthCheckerWithLogger(serverType string, l Logger) *HealthChecker {
 	hc := HealthChecker{
 		serverType:    serverType,
 		done:          make(chan bool),
 		quit:          make(chan os.Signal, 1),
-		shutdownFuncs: make([]ShutDownFunc, 0),
+		shutdownFuncs: make([]shutdownFuncEntry, 0),
+		logger:        l,
 		readyToServe:  true,
-		checkers:      make(map[string]Checker, 0),
+		checkers:      make(map[string]*checkerState, 0),
 	}
 	signal.Notify(hc.quit, os.Interrupt, syscall.SIGTERM)
 	go hc.handleShutdownFuncs()
 	go func() {
 		for {
 			hc.runHealthChecks(context.Background())
-			time.Sleep(healthCheckPeriod)
+			time.Sleep(hc.nextTick())
 		}
 	}()
 	return &hc
@@ -71,46 +271,110 @@ func NewHealthChecker(serverType string) *HealthChecker {
 func (h *HealthChecker) handleShutdownFuncs() {
 	<-h.quit
 
+	// Phase 1: lame-duck. Flip readiness so the load balancer stops
+	// sending new traffic, but keep LivenessHandler (and in-flight RPCs)
+	// succeeding while it catches up to the readiness change.
 	h.lock.Lock()
 	h.readyToServe = false
+	h.inLameDuck = true
+	h.lock.Unlock()
+
+	h.logger.Infof("Caught interrupt signal; entering lame-duck for %s before shutting down...", *shutdownLameDuckDuration)
+	time.Sleep(*shutdownLameDuckDuration)
+
+	h.lock.Lock()
+	h.inLameDuck = false
 	h.shuttingDown = true
 	h.lock.Unlock()
 
-	// We use fmt here and below because this code is called from the
-	// signal handler and log.Printf can be a little wonky.
-	fmt.Printf("Caught interrupt signal; shutting down...\n")
+	h.logger.Infof("Lame-duck period elapsed; running shutdown functions...")
 	ctx, cancel := context.WithTimeout(context.Background(), *maxShutdownDuration)
 	defer cancel()
 
-	eg, egCtx := errgroup.WithContext(ctx)
-	for _, fn := range h.shutdownFuncs {
-		f := fn
-		eg.Go(func() error {
-			if err := f(egCtx); err != nil {
-				fmt.Printf("Error gracefully shutting down: %s\n", err)
-			}
-			return nil
-		})
-	}
-	eg.Wait()
-	if err := ctx.Err(); err != nil {
-		fmt.Printf("MaxShutdownDuration exceeded. Non-graceful exit.\n")
+	for _, stage := range shutdownStages(h.shutdownFuncs) {
+		eg, egCtx := errgroup.WithContext(ctx)
+		for _, fn := range stage {
+			f := fn
+			eg.Go(func() error {
+				if err := f(egCtx); err != nil {
+					h.logger.Errorf("Error gracefully shutting down: %s", err)
+				}
+				return nil
+			})
+		}
+		eg.Wait()
+		if err := ctx.Err(); err != nil {
+			h.logger.Warningf("MaxShutdownDuration exceeded. Non-graceful exit.")
+			break
+		}
 	}
 	time.Sleep(10 * time.Millisecond)
-	fmt.Printf("Server %q stopped.\n", h.serverType)
+	h.logger.Infof("Server %q stopped.", h.serverType)
 	close(h.done)
 }
 
+// shutdownStages groups entries into ordered stages by ascending
+// priority, so that e.g. "stop accepting new work" (a low priority)
+// finishes before "close DB" (a higher priority) begins, while functions
+// within the same stage still run concurrently.
+func shutdownStages(entries []shutdownFuncEntry) [][]ShutDownFunc {
+	byPriority := make(map[int][]ShutDownFunc)
+	priorities := make([]int, 0)
+	for _, e := range entries {
+		if _, ok := byPriority[e.priority]; !ok {
+			priorities = append(priorities, e.priority)
+		}
+		byPriority[e.priority] = append(byPriority[e.priority], e.fn)
+	}
+	sort.Ints(priorities)
+
+	stages := make([][]ShutDownFunc, 0, len(priorities))
+	for _, p := range priorities {
+		stages = append(stages, byPriority[p])
+	}
+	return stages
+}
+
+// RegisterShutdownFunction registers f to run on shutdown, after the
+// lame-duck period has elapsed. Equivalent to
+// RegisterShutdownFunctionWithPriority(f, 0).
 func (h *HealthChecker) RegisterShutdownFunction(f ShutDownFunc) {
-	h.shutdownFuncs = append(h.shutdownFuncs, f)
+	h.RegisterShutdownFunctionWithPriority(f, 0)
+}
+
+// RegisterShutdownFunctionWithPriority registers f to run on shutdown in
+// the stage matching priority. Stages run in ascending priority order,
+// one at a time; functions registered with the same priority run
+// concurrently within their stage. This lets a service order shutdown as
+// e.g. stop accepting new work (priority 0) -> drain queues (priority 1)
+// -> close DB (priority 2), instead of tearing everything down at once.
+func (h *HealthChecker) RegisterShutdownFunctionWithPriority(f ShutDownFunc, priority int) {
+	h.shutdownFuncs = append(h.shutdownFuncs, shutdownFuncEntry{fn: f, priority: priority})
 }
 
 func (h *HealthChecker) AddHealthCheck(name string, f Checker) {
-	// Mark the service as unhealthy until the healthcheck runs
-	// and it becomes healthy.
+	h.AddHealthCheckWithOptions(name, f, CheckOptions{Severity: SeverityCritical})
+}
+
+// AddHealthCheckWithOptions registers a checker along with its severity
+// and thresholds. SeverityCritical checkers gate readiness, as
+// AddHealthCheck's checkers always have; SeverityDegraded and
+// SeverityInfo checkers only ever appear in Status/DetailsHandler and
+// never flip readiness, so a flaky non-essential dependency doesn't take
+// the service out of the load balancing pool.
+func (h *HealthChecker) AddHealthCheckWithOptions(name string, c Checker, opts CheckOptions) {
+	opts = opts.withDefaults()
+
 	h.lock.Lock()
-	h.checkers[name] = f
-	h.readyToServe = false
+	h.checkers[name] = &checkerState{checker: c, opts: opts}
+	// Mark the service as unhealthy until the healthcheck has run. After
+	// that, readiness follows the checker's down state: with the default
+	// FailureThreshold of 1 (as AddHealthCheck uses) the service stays
+	// unhealthy until the check passes, but with a higher threshold a
+	// failing first run does not yet mark the checker down.
+	if opts.Severity == SeverityCritical {
+		h.readyToServe = false
+	}
 	h.lock.Unlock()
 }
 
@@ -118,46 +382,115 @@ func (h *HealthChecker) WaitForGracefulShutdown() {
 	<-h.done
 }
 
+// Status returns a point-in-time snapshot of every registered checker,
+// sorted by name, so that operators can see which dependency (if any) is
+// responsible for an unhealthy readiness state.
+func (h *HealthChecker) Status(ctx context.Context) []CheckerStatus {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	statuses := make([]CheckerStatus, 0, len(h.checkers))
+	for name, cs := range h.checkers {
+		statuses = append(statuses, cs.status(name))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// nextTick returns how long the scheduling loop should sleep before its
+// next pass: the soonest time any registered checker is next due,
+// clamped between minHealthCheckTick and healthCheckPeriod. This is what
+// lets a checker's CheckOptions.Interval be shorter than healthCheckPeriod
+// and still actually take effect.
+func (h *HealthChecker) nextTick() time.Duration {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	next := healthCheckPeriod
+	now := time.Now()
+	for _, cs := range h.checkers {
+		if due := cs.opts.Interval - now.Sub(cs.lastRun); due < next {
+			next = due
+		}
+	}
+	if next < minHealthCheckTick {
+		next = minHealthCheckTick
+	}
+	return next
+}
+
 func (h *HealthChecker) runHealthChecks(ctx context.Context) {
 	h.lock.RLock()
-	bail := h.shuttingDown
+	bail := h.shuttingDown || h.inLameDuck
 	h.lock.RUnlock()
 	if bail {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
-	defer cancel()
+	now := time.Now()
+	h.lock.RLock()
+	due := make(map[string]*checkerState, len(h.checkers))
+	for name, cs := range h.checkers {
+		if now.Sub(cs.lastRun) >= cs.opts.Interval {
+			due[name] = cs
+		}
+	}
+	h.lock.RUnlock()
 
 	eg, ctx := errgroup.WithContext(ctx)
-	for name, ck := range h.checkers {
+	for name, cs := range due {
+		name, cs := name, cs
 		eg.Go(func() error {
-			if err := ck.Check(ctx); err != nil {
-				return status.UnavailableErrorf("Service %s is unhealthy: %s", name, err)
+			// Each checker gets its own timeout so that a checker with a
+			// longer CheckOptions.Timeout isn't cut short by another
+			// checker's deadline.
+			checkCtx, cancel := context.WithTimeout(ctx, cs.opts.Timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := cs.checker.Check(checkCtx)
+			latency := time.Since(start)
+
+			h.lock.Lock()
+			wasDown, nowDown := cs.recordResult(start, latency, err)
+			h.lock.Unlock()
+
+			if err != nil {
+				h.logger.Warningf("Checker %q (severity=%s) failed: %s", name, cs.opts.Severity, err)
+			} else if wasDown && !nowDown {
+				h.logger.Infof("Checker %q (severity=%s) recovered", name, cs.opts.Severity)
 			}
+
 			return nil
 		})
 	}
-	err := eg.Wait()
-	newReadinessState := true
-	if err != nil {
-		newReadinessState = false
-		log.Printf("Checker err: %s", err)
-	}
+	eg.Wait()
 
-	previousReadinessState := false
 	h.lock.Lock()
+	previousReadinessState := h.readyToServe
 	if !h.shuttingDown {
-		previousReadinessState = h.readyToServe
-		h.readyToServe = newReadinessState
+		allCriticalUp := true
+		for name, cs := range h.checkers {
+			if cs.opts.Severity == SeverityCritical && cs.down {
+				allCriticalUp = false
+				h.logger.Warningf("Checker %q is down, not ready", name)
+			}
+		}
+		h.readyToServe = allCriticalUp
 	}
+	newReadinessState := h.readyToServe
 	h.lock.Unlock()
 
 	if newReadinessState != previousReadinessState {
-		log.Printf("HealthChecker transitioning from ready: %t => ready: %t", previousReadinessState, newReadinessState)
+		h.logger.Infof("HealthChecker transitioning from ready: %t => ready: %t", previousReadinessState, newReadinessState)
 	}
 }
 
+// ReadinessHandler reports not-ready once a SeverityCritical checker is
+// down (see CheckOptions.FailureThreshold) or once
+// shutdown has started, including the lame-duck period, so that load
+// balancers stop routing new connections before shutdown functions (and
+// in-flight RPCs) finish running.
 func (h *HealthChecker) ReadinessHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		reqServerType := serverType(r)
@@ -175,11 +508,14 @@ func (h *HealthChecker) ReadinessHandler() http.Handler {
 			return
 		}
 		err := fmt.Errorf("Server type: '%s' unknown (did not match: %q)", reqServerType, h.serverType)
-		log.Printf("Readiness check returning error: %s", err)
+		h.logger.Warningf("Readiness check returning error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	})
 }
 
+// LivenessHandler always reports success for a matching server type, even
+// during the lame-duck period, so that the process isn't killed out from
+// under in-flight RPCs while it's draining.
 func (h *HealthChecker) LivenessHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		reqServerType := serverType(r)
@@ -188,11 +524,31 @@ func (h *HealthChecker) LivenessHandler() http.Handler {
 			return
 		}
 		err := fmt.Errorf("Server type: '%s' unknown (did not match: %q)", reqServerType, h.serverType)
-		log.Printf("Liveness check returning error: %s", err)
+		h.logger.Warningf("Liveness check returning error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	})
 }
 
+// DetailsHandler returns the current Status of every registered checker as
+// JSON, so that dashboards and alerting can distinguish a transient blip
+// from a sustained outage on a specific dependency, rather than only
+// seeing the aggregate ready/not-ready bit.
+func (h *HealthChecker) DetailsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqServerType := serverType(r)
+		if reqServerType != h.serverType {
+			err := fmt.Errorf("Server type: '%s' unknown (did not match: %q)", reqServerType, h.serverType)
+			h.logger.Warningf("Health details check returning error: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.Status(r.Context())); err != nil {
+			h.logger.Errorf("Error encoding health details: %s", err)
+		}
+	})
+}
+
 // serverType is dervied from either the headers or a query parameter
 func serverType(r *http.Request) string {
 	if r.Header.Get("server-type") != "" {
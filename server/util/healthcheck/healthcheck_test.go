@@ -0,0 +1,162 @@
+package healthcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOptions_WithDefaults(t *testing.T) {
+	o := CheckOptions{}.withDefaults()
+	assert.Equal(t, 1, o.FailureThreshold)
+	assert.Equal(t, 1, o.SuccessThreshold)
+	assert.Equal(t, healthCheckPeriod, o.Interval)
+	assert.Equal(t, healthCheckTimeout, o.Timeout)
+
+	o = CheckOptions{FailureThreshold: 3, SuccessThreshold: 2, Interval: time.Second, Timeout: time.Millisecond}.withDefaults()
+	assert.Equal(t, 3, o.FailureThreshold)
+	assert.Equal(t, 2, o.SuccessThreshold)
+	assert.Equal(t, time.Second, o.Interval)
+	assert.Equal(t, time.Millisecond, o.Timeout)
+}
+
+func TestCheckerState_RecordResult_Thresholds(t *testing.T) {
+	cs := &checkerState{opts: CheckOptions{FailureThreshold: 2, SuccessThreshold: 2}.withDefaults()}
+	errBoom := errors.New("boom")
+	now := time.Now()
+
+	// A single failure doesn't cross the FailureThreshold of 2.
+	wasDown, nowDown := cs.recordResult(now, time.Millisecond, errBoom)
+	assert.False(t, wasDown)
+	assert.False(t, nowDown)
+
+	// The second consecutive failure crosses it.
+	wasDown, nowDown = cs.recordResult(now, time.Millisecond, errBoom)
+	assert.False(t, wasDown)
+	assert.True(t, nowDown)
+
+	// A single success doesn't cross the SuccessThreshold of 2, so the
+	// checker is still reported down.
+	wasDown, nowDown = cs.recordResult(now, time.Millisecond, nil)
+	assert.True(t, wasDown)
+	assert.True(t, nowDown)
+
+	// The second consecutive success recovers it.
+	wasDown, nowDown = cs.recordResult(now, time.Millisecond, nil)
+	assert.True(t, wasDown)
+	assert.False(t, nowDown)
+}
+
+func TestCheckerState_RecordResult_ResetsOppositeCounter(t *testing.T) {
+	cs := &checkerState{opts: CheckOptions{FailureThreshold: 3, SuccessThreshold: 3}.withDefaults()}
+	errBoom := errors.New("boom")
+	now := time.Now()
+
+	cs.recordResult(now, 0, errBoom)
+	cs.recordResult(now, 0, errBoom)
+	require.Equal(t, 2, cs.consecutiveFailures)
+
+	// An intervening success resets consecutiveFailures, so a subsequent
+	// failure starts counting from 1 again rather than 3.
+	cs.recordResult(now, 0, nil)
+	assert.Equal(t, 0, cs.consecutiveFailures)
+
+	_, nowDown := cs.recordResult(now, 0, errBoom)
+	assert.Equal(t, 1, cs.consecutiveFailures)
+	assert.False(t, nowDown)
+}
+
+func TestShutdownStages_OrdersByPriorityAndGroupsSamePriority(t *testing.T) {
+	noop := func(ctx context.Context) error { return nil }
+	entries := []shutdownFuncEntry{
+		{fn: noop, priority: 2},
+		{fn: noop, priority: 0},
+		{fn: noop, priority: 1},
+		{fn: noop, priority: 0},
+	}
+
+	stages := shutdownStages(entries)
+	require.Len(t, stages, 3)
+	assert.Len(t, stages[0], 2, "priority-0 stage should group both priority-0 entries")
+	assert.Len(t, stages[1], 1)
+	assert.Len(t, stages[2], 1)
+}
+
+func TestShutdownStages_Empty(t *testing.T) {
+	assert.Empty(t, shutdownStages(nil))
+}
+
+func TestHealthChecker_NextTick_HonorsShorterInterval(t *testing.T) {
+	shortInterval := 500 * time.Millisecond
+	hc := &HealthChecker{checkers: map[string]*checkerState{
+		"fast": {
+			opts:    CheckOptions{Interval: shortInterval}.withDefaults(),
+			lastRun: time.Now(),
+		},
+	}}
+	assert.Less(t, hc.nextTick(), healthCheckPeriod, "a checker due sooner than healthCheckPeriod should shorten the tick")
+	assert.GreaterOrEqual(t, hc.nextTick(), minHealthCheckTick)
+}
+
+func TestHealthChecker_NextTick_FallsBackToDefaultPeriod(t *testing.T) {
+	hc := &HealthChecker{checkers: map[string]*checkerState{}}
+	assert.Equal(t, healthCheckPeriod, hc.nextTick())
+}
+
+func TestHealthChecker_NextTick_ClampsToFloor(t *testing.T) {
+	// A checker whose Interval has long since elapsed is immediately due,
+	// which would otherwise compute a large negative "due" duration; make
+	// sure nextTick clamps that up to minHealthCheckTick instead of
+	// returning early or negative.
+	hc := &HealthChecker{checkers: map[string]*checkerState{
+		"overdue": {
+			opts:    CheckOptions{Interval: time.Millisecond}.withDefaults(),
+			lastRun: time.Now().Add(-time.Hour),
+		},
+	}}
+	assert.Equal(t, minHealthCheckTick, hc.nextTick())
+}
+
+func TestHealthChecker_StatusAndDetailsHandler(t *testing.T) {
+	hc := &HealthChecker{
+		serverType: "test-server",
+		logger:     defaultLogger{},
+		checkers:   make(map[string]*checkerState),
+	}
+	errBoom := errors.New("boom")
+	hc.AddHealthCheckWithOptions("flaky", CheckerFunc(func(ctx context.Context) error { return errBoom }), CheckOptions{})
+
+	start := time.Now()
+	hc.checkers["flaky"].recordResult(start, 5*time.Millisecond, errBoom)
+
+	statuses := hc.Status(context.Background())
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "flaky", statuses[0].Name)
+	assert.False(t, statuses[0].OK)
+	assert.True(t, statuses[0].Down)
+	assert.Equal(t, "boom", statuses[0].LastError)
+	assert.Equal(t, 1, statuses[0].ConsecutiveFailures)
+	assert.Equal(t, 5*time.Millisecond, statuses[0].Latency)
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz/details", nil)
+	req.Header.Set("server-type", "test-server")
+	rec := httptest.NewRecorder()
+	hc.DetailsHandler().ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got []CheckerStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, "flaky", got[0].Name)
+	assert.False(t, got[0].OK)
+	assert.True(t, got[0].Down)
+	assert.Equal(t, "boom", got[0].LastError)
+	assert.Equal(t, 1, got[0].ConsecutiveFailures)
+}